@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -16,7 +17,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -42,36 +42,53 @@ var (
 func init() {
 	flag.StringVar(&port, "port", "80", "give me a port number")
 	flag.StringVar(&name, "name", os.Getenv("WHOAMI_NAME"), "give me a name")
+	flag.StringVar(&cert, "cert", "", "give me a certificate file for mutual TLS")
+	flag.StringVar(&key, "key", "", "give me a key file for mutual TLS")
+	flag.StringVar(&ca, "ca", "", "give me a CA file to verify client certificates against for mutual TLS")
 }
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
 }
 
 func main() {
 	flag.Parse()
 
-	http.HandleFunc("/data", dataHandler)
-	http.HandleFunc("/echo", echoHandler)
-	http.HandleFunc("/bench", benchHandler)
-	http.HandleFunc("/", whoamiHandler)
-	http.HandleFunc("/api", apiHandler)
-	http.HandleFunc("/health", healthHandler)
+	openGeoIP()
+	setupRateLimiting()
+
+	http.HandleFunc("/data", instrumentHandler("/data", rateLimit("/data", dataHandler)))
+	http.HandleFunc("/echo", instrumentHandler("/echo", rateLimit("/echo", echoHandler)))
+	http.HandleFunc("/bench", instrumentHandler("/bench", rateLimit("/bench", benchHandler)))
+	http.HandleFunc("/", instrumentHandler("/", rateLimit("/", whoamiHandler)))
+	http.HandleFunc("/api", instrumentHandler("/api", rateLimit("/api", apiHandler)))
+	http.HandleFunc("/healthz/live", instrumentHandler("/healthz/live", simpleProbeHandler(liveState)))
+	http.HandleFunc("/healthz/ready", instrumentHandler("/healthz/ready", readyHandler))
+	http.HandleFunc("/healthz/startup", instrumentHandler("/healthz/startup", simpleProbeHandler(startupState)))
+	http.HandleFunc("/health", instrumentHandler("/health", simpleProbeHandler(liveState)))
+	serveMetrics()
 
 	fmt.Println("Starting up on port " + port)
 
 	server := &http.Server{
 		Addr: ":" + port,
 	}
+	setupGracefulDrain(server)
+
+	if cert != "" && key != "" && ca != "" {
+		server.TLSConfig = setupMutualTLS(ca)
+		exitAfterServe(server.ListenAndServeTLS(cert, key))
+	}
 
 	_, errCrt := os.Stat("/cert/tls.crt")
 	_, errKey := os.Stat("/cert/tls.key")
 	if errCrt != nil || errKey != nil {
-		log.Fatal(server.ListenAndServe())
+		exitAfterServe(server.ListenAndServe())
 	}
 
-	log.Fatal(server.ListenAndServeTLS("/cert/tls.crt", "/cert/tls.key"))
+	exitAfterServe(server.ListenAndServeTLS("/cert/tls.crt", "/cert/tls.key"))
 }
 
 func setupMutualTLS(ca string) *tls.Config {
@@ -93,33 +110,51 @@ func setupMutualTLS(ca string) *tls.Config {
 	return tlsConfig
 }
 
-func benchHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Content-Type", "text/plain")
-	_, _ = fmt.Fprint(w, "1")
+// ClientCert holds the bits of a client certificate we surface for
+// mTLS debugging in whoamiHandler and apiHandler.
+type ClientCert struct {
+	CommonName   string   `json:"commonName,omitempty"`
+	SANs         []string `json:"sans,omitempty"`
+	SerialNumber string   `json:"serialNumber,omitempty"`
+	NotBefore    string   `json:"notBefore,omitempty"`
+	NotAfter     string   `json:"notAfter,omitempty"`
+	Fingerprint  string   `json:"fingerprint,omitempty"`
 }
 
-func echoHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+func clientCertFromRequest(req *http.Request) *ClientCert {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
 	}
 
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			return
-		}
+	c := req.TLS.PeerCertificates[0]
 
-		printBinary(p)
-		err = conn.WriteMessage(messageType, p)
-		if err != nil {
-			return
-		}
+	var sans []string
+	sans = append(sans, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range c.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	fingerprint := sha256.Sum256(c.Raw)
+
+	return &ClientCert{
+		CommonName:   c.Subject.CommonName,
+		SANs:         sans,
+		SerialNumber: c.SerialNumber.String(),
+		NotBefore:    c.NotBefore.Format(time.RFC3339),
+		NotAfter:     c.NotAfter.Format(time.RFC3339),
+		Fingerprint:  fmt.Sprintf("%x", fingerprint),
 	}
 }
 
+func benchHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprint(w, "1")
+}
+
 func printBinary(s []byte) {
 	fmt.Printf("Received b:")
 	for n := 0; n < len(s); n++ {
@@ -140,8 +175,8 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 		size = 0
 	}
 
-	unit := queryParams.Get("unit")
-	switch strings.ToLower(unit) {
+	unit := strings.ToLower(queryParams.Get("unit"))
+	switch unit {
 	case "kb":
 		size *= KB
 	case "mb":
@@ -150,6 +185,8 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 		size *= GB
 	case "tb":
 		size *= TB
+	default:
+		unit = "b"
 	}
 
 	attachment, err := strconv.ParseBool(queryParams.Get("attachment"))
@@ -158,6 +195,7 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	content := fillContent(size)
+	dataBytesServedTotal.WithLabelValues(unit).Add(float64(size))
 
 	if attachment {
 		w.Header().Set("Content-Disposition", "Attachment")
@@ -205,6 +243,24 @@ func whoamiHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	_, _ = fmt.Fprintln(w, "RemoteAddr:", req.RemoteAddr)
+
+	if loc := locateRequest(req); loc != nil {
+		_, _ = fmt.Fprintln(w, "Location City:", loc.City)
+		_, _ = fmt.Fprintln(w, "Location Country:", loc.Country)
+		_, _ = fmt.Fprintln(w, "Location Continent:", loc.Continent)
+		_, _ = fmt.Fprintln(w, "Location Latitude:", loc.Latitude)
+		_, _ = fmt.Fprintln(w, "Location Longitude:", loc.Longitude)
+	}
+
+	if cc := clientCertFromRequest(req); cc != nil {
+		_, _ = fmt.Fprintln(w, "ClientCert CN:", cc.CommonName)
+		_, _ = fmt.Fprintln(w, "ClientCert SANs:", strings.Join(cc.SANs, ","))
+		_, _ = fmt.Fprintln(w, "ClientCert Serial:", cc.SerialNumber)
+		_, _ = fmt.Fprintln(w, "ClientCert NotBefore:", cc.NotBefore)
+		_, _ = fmt.Fprintln(w, "ClientCert NotAfter:", cc.NotAfter)
+		_, _ = fmt.Fprintln(w, "ClientCert Fingerprint:", cc.Fingerprint)
+	}
+
 	if err := req.Write(w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -215,21 +271,25 @@ func apiHandler(w http.ResponseWriter, req *http.Request) {
 	hostname, _ := os.Hostname()
 
 	data := struct {
-		Hostname string      `json:"hostname,omitempty"`
-		IP       []string    `json:"ip,omitempty"`
-		Headers  http.Header `json:"headers,omitempty"`
-		URL      string      `json:"url,omitempty"`
-		Host     string      `json:"host,omitempty"`
-		Method   string      `json:"method,omitempty"`
-		Name     string      `json:"name,omitempty"`
+		Hostname   string      `json:"hostname,omitempty"`
+		IP         []string    `json:"ip,omitempty"`
+		Headers    http.Header `json:"headers,omitempty"`
+		URL        string      `json:"url,omitempty"`
+		Host       string      `json:"host,omitempty"`
+		Method     string      `json:"method,omitempty"`
+		Name       string      `json:"name,omitempty"`
+		ClientCert *ClientCert `json:"clientCert,omitempty"`
+		Location   *Location   `json:"location,omitempty"`
 	}{
-		Hostname: hostname,
-		IP:       []string{},
-		Headers:  req.Header,
-		URL:      req.URL.RequestURI(),
-		Host:     req.Host,
-		Method:   req.Method,
-		Name:     name,
+		Hostname:   hostname,
+		IP:         []string{},
+		Headers:    req.Header,
+		URL:        req.URL.RequestURI(),
+		Host:       req.Host,
+		Method:     req.Method,
+		Name:       name,
+		ClientCert: clientCertFromRequest(req),
+		Location:   locateRequest(req),
 	}
 
 	ifaces, _ := net.Interfaces()
@@ -257,36 +317,6 @@ func apiHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-type healthState struct {
-	StatusCode int
-}
-
-var (
-	currentHealthState = healthState{http.StatusOK}
-	mutexHealthState   = &sync.RWMutex{}
-)
-
-func healthHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodPost {
-		var statusCode int
-
-		if err := json.NewDecoder(req.Body).Decode(&statusCode); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		fmt.Printf("Update health check status code [%d]\n", statusCode)
-
-		mutexHealthState.Lock()
-		defer mutexHealthState.Unlock()
-		currentHealthState.StatusCode = statusCode
-	} else {
-		mutexHealthState.RLock()
-		defer mutexHealthState.RUnlock()
-		w.WriteHeader(currentHealthState.StatusCode)
-	}
-}
-
 func fillContent(length int64) io.ReadSeeker {
 	charset := "-ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	b := make([]byte, length)
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var (
+	geoipPath      string
+	trustForwarded bool
+)
+
+func init() {
+	flag.StringVar(&geoipPath, "geoip", "", "give me a MaxMind GeoLite2 City .mmdb file to enrich RemoteAddr with location data")
+	flag.BoolVar(&trustForwarded, "trust-forwarded", false, "trust X-Forwarded-For/X-Real-IP when resolving the client IP for GeoIP lookups and per-IP rate limiting")
+}
+
+var (
+	geoipMutex sync.Mutex
+	geoipDB    *geoip2.Reader
+)
+
+func openGeoIP() {
+	if geoipPath == "" {
+		return
+	}
+
+	db, err := geoip2.Open(geoipPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	geoipMutex.Lock()
+	geoipDB = db
+	geoipMutex.Unlock()
+}
+
+// Location is the GeoIP enrichment attached to whoamiHandler/apiHandler
+// output when -geoip is configured and the lookup succeeds.
+type Location struct {
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	Continent string  `json:"continent,omitempty"`
+}
+
+const geoipCacheTTL = 30 * 24 * time.Hour
+const geoipCacheMaxEntries = 10000
+
+type geoipCacheEntry struct {
+	key       string
+	location  Location
+	expiresAt time.Time
+}
+
+var (
+	geoipCacheMutex sync.Mutex
+	geoipCacheList  = list.New()
+	geoipCacheIndex = map[string]*list.Element{}
+)
+
+func geoipCacheGet(ip string) (Location, bool) {
+	geoipCacheMutex.Lock()
+	defer geoipCacheMutex.Unlock()
+
+	elem, ok := geoipCacheIndex[ip]
+	if !ok {
+		return Location{}, false
+	}
+
+	entry := elem.Value.(*geoipCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		geoipCacheList.Remove(elem)
+		delete(geoipCacheIndex, ip)
+		return Location{}, false
+	}
+
+	geoipCacheList.MoveToFront(elem)
+	return entry.location, true
+}
+
+func geoipCacheSet(ip string, loc Location) {
+	geoipCacheMutex.Lock()
+	defer geoipCacheMutex.Unlock()
+
+	if elem, ok := geoipCacheIndex[ip]; ok {
+		elem.Value.(*geoipCacheEntry).location = loc
+		elem.Value.(*geoipCacheEntry).expiresAt = time.Now().Add(geoipCacheTTL)
+		geoipCacheList.MoveToFront(elem)
+		return
+	}
+
+	elem := geoipCacheList.PushFront(&geoipCacheEntry{
+		key:       ip,
+		location:  loc,
+		expiresAt: time.Now().Add(geoipCacheTTL),
+	})
+	geoipCacheIndex[ip] = elem
+
+	if geoipCacheList.Len() > geoipCacheMaxEntries {
+		oldest := geoipCacheList.Back()
+		if oldest != nil {
+			geoipCacheList.Remove(oldest)
+			delete(geoipCacheIndex, oldest.Value.(*geoipCacheEntry).key)
+		}
+	}
+}
+
+// clientIP resolves the client address used for the GeoIP lookup and the
+// per-IP rate limiter, honoring X-Forwarded-For/X-Real-IP only when
+// -trust-forwarded is set.
+func clientIP(req *http.Request) string {
+	if trustForwarded {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[0])
+		}
+		if xrip := req.Header.Get("X-Real-IP"); xrip != "" {
+			return strings.TrimSpace(xrip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// locateRequest looks up the GeoIP location for req's client IP, returning
+// nil if GeoIP isn't configured or the lookup fails.
+func locateRequest(req *http.Request) *Location {
+	geoipMutex.Lock()
+	db := geoipDB
+	geoipMutex.Unlock()
+
+	if db == nil {
+		return nil
+	}
+
+	ipStr := clientIP(req)
+	if loc, ok := geoipCacheGet(ipStr); ok {
+		return &loc
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil
+	}
+
+	record, err := db.City(ip)
+	if err != nil {
+		return nil
+	}
+
+	loc := Location{
+		Latitude:  record.Location.Latitude,
+		Longitude: record.Location.Longitude,
+		City:      record.City.Names["en"],
+		Country:   record.Country.Names["en"],
+		Continent: record.Continent.Names["en"],
+	}
+
+	// MaxMind doesn't error on private/loopback/unresolvable IPs, it just
+	// returns an empty record. Treat that the same as a failed lookup
+	// instead of caching and emitting an all-zero Location.
+	if loc == (Location{}) {
+		return nil
+	}
+
+	geoipCacheSet(ipStr, loc)
+	return &loc
+}
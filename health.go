@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var drainGrace time.Duration
+
+func init() {
+	flag.DurationVar(&drainGrace, "drain-grace", 30*time.Second, "give me how long to keep liveness green after SIGTERM while readiness drains")
+}
+
+// probeState is a settable status code backing one of the /healthz
+// endpoints, toggled via POST with a {"code":...,"reason":...} JSON body.
+type probeState struct {
+	mu     sync.RWMutex
+	code   int
+	reason string
+}
+
+func (p *probeState) set(code int, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.code = code
+	p.reason = reason
+}
+
+func (p *probeState) get() (int, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.code, p.reason
+}
+
+var (
+	liveState    = &probeState{code: http.StatusOK}
+	readyState   = &probeState{code: http.StatusOK}
+	startupState = &probeState{code: http.StatusOK}
+)
+
+type probeUpdate struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// simpleProbeHandler backs /healthz/live and /healthz/startup: GET returns
+// the current status code, POST overrides it.
+func simpleProbeHandler(state *probeState) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			var update probeUpdate
+			if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			fmt.Printf("Update probe status code [%d] reason [%s]\n", update.Code, update.Reason)
+			state.set(update.Code, update.Reason)
+			return
+		}
+
+		code, _ := state.get()
+		w.WriteHeader(code)
+	}
+}
+
+// ReadinessCheck reports whether a dependency is ready to serve traffic.
+type ReadinessCheck func(ctx context.Context) error
+
+var (
+	readinessChecksMutex sync.Mutex
+	readinessChecks      = map[string]ReadinessCheck{}
+)
+
+// RegisterReadinessCheck registers a named check that /healthz/ready runs
+// on every GET while its status has not been overridden to a non-200 code.
+// Registering the same name twice replaces the check.
+func RegisterReadinessCheck(name string, check ReadinessCheck) {
+	readinessChecksMutex.Lock()
+	defer readinessChecksMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+const defaultReadinessCheckTimeout = 2 * time.Second
+
+type readinessCheckResult struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks []readinessCheckResult `json:"checks,omitempty"`
+}
+
+// readyHandler backs /healthz/ready. POST overrides the status the same
+// way the other probes do (used to force a drain); while that status is
+// non-200, GET returns it with the reason and runs no checks. Otherwise GET
+// runs every registered readiness check in parallel and reports the aggregate.
+func readyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		var update probeUpdate
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Printf("Update readiness status code [%d] reason [%s]\n", update.Code, update.Reason)
+		readyState.set(update.Code, update.Reason)
+		return
+	}
+
+	if code, reason := readyState.get(); code != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(readinessReport{Status: reason})
+		return
+	}
+
+	timeout := defaultReadinessCheckTimeout
+	if raw := req.URL.Query().Get("timeout"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil {
+			timeout = d
+		}
+	}
+
+	readinessChecksMutex.Lock()
+	checks := make(map[string]ReadinessCheck, len(readinessChecks))
+	for name, check := range readinessChecks {
+		checks[name] = check
+	}
+	readinessChecksMutex.Unlock()
+
+	results := make([]readinessCheckResult, len(checks))
+	var wg sync.WaitGroup
+	i := 0
+	for name, check := range checks {
+		wg.Add(1)
+		go func(i int, name string, check ReadinessCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+
+			results[i] = readinessCheckResult{
+				Name:      name,
+				OK:        err == nil,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, name, check)
+		i++
+	}
+	wg.Wait()
+
+	status, httpStatus := "ok", http.StatusOK
+	for _, r := range results {
+		if !r.OK {
+			status, httpStatus = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(readinessReport{Status: status, Checks: results})
+}
+
+// setupGracefulDrain traps SIGTERM, flips readiness to 503 immediately so
+// load balancers stop routing new traffic, keeps liveness green for
+// -drain-grace so in-flight connections can finish, then shuts the server
+// down.
+func setupGracefulDrain(server *http.Server) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		fmt.Println("Received SIGTERM, draining before shutdown")
+		readyState.set(http.StatusServiceUnavailable, "draining")
+
+		time.Sleep(drainGrace)
+
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Println(err)
+		}
+		close(shutdownDone)
+	}()
+}
+
+// shutdownDone is closed once setupGracefulDrain's Shutdown call returns.
+var shutdownDone = make(chan struct{})
+
+// exitAfterServe is how main ends after its ListenAndServe(TLS) call
+// returns. http.ErrServerClosed means setupGracefulDrain's Shutdown did its
+// job, so that's a clean exit rather than the fatal error every other
+// listener failure is.
+func exitAfterServe(err error) {
+	if errors.Is(err, http.ErrServerClosed) {
+		// ListenAndServe returns as soon as Shutdown starts; wait for it to
+		// finish draining connections before exiting.
+		<-shutdownDone
+		fmt.Println("Server shut down gracefully")
+		os.Exit(0)
+	}
+	log.Fatal(err)
+}
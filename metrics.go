@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsBind string
+
+func init() {
+	flag.StringVar(&metricsBind, "metrics-bind", "", "give me an address to serve /metrics on (empty serves it alongside the other handlers)")
+}
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests handled, labeled by path, method and status.",
+	}, []string{"path", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, labeled by path and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path", "method"})
+
+	httpRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of HTTP requests currently being served, labeled by path.",
+	}, []string{"path"})
+
+	httpResponseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_response_bytes_total",
+		Help: "Total bytes written in HTTP responses, labeled by path, method and status.",
+	}, []string{"path", "method", "status"})
+
+	websocketActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_active_connections",
+		Help: "Number of currently open /echo WebSocket connections.",
+	})
+
+	websocketMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_total",
+		Help: "Total number of WebSocket messages, labeled by direction (in/out).",
+	}, []string{"direction"})
+
+	websocketMessageBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "websocket_message_bytes",
+		Help:    "Size in bytes of WebSocket messages exchanged on /echo.",
+		Buckets: prometheus.ExponentialBuckets(32, 4, 8),
+	})
+
+	dataBytesServedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "data_bytes_served_total",
+		Help: "Total bytes served by /data, labeled by unit.",
+	}, []string{"unit"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		httpResponseBytesTotal,
+		websocketActiveConnections,
+		websocketMessagesTotal,
+		websocketMessageBytes,
+		dataBytesServedTotal,
+	)
+}
+
+// metricsResponseWriter records the status code and byte count written
+// through it so instrumentHandler can feed them into the request metrics.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int
+}
+
+func (w *metricsResponseWriter) WriteHeader(code int) {
+	w.statusCode = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += n
+	return n, err
+}
+
+// Hijack lets instrumented handlers (notably the /echo WebSocket upgrade)
+// take over the underlying connection the same way they could before being
+// wrapped for metrics.
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("metrics: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return hijacker.Hijack()
+}
+
+// instrumentHandler wraps h so every request against path records request
+// count, duration, in-flight gauge and bytes written in Prometheus.
+func instrumentHandler(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpRequestsInFlight.WithLabelValues(path).Inc()
+		defer httpRequestsInFlight.WithLabelValues(path).Dec()
+
+		start := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		h(mw, r)
+
+		status := strconv.Itoa(mw.statusCode)
+		httpRequestsTotal.WithLabelValues(path, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+		httpResponseBytesTotal.WithLabelValues(path, r.Method, status).Add(float64(mw.bytesWritten))
+	}
+}
+
+// serveMetrics registers the /metrics endpoint, either on the main mux or,
+// when -metrics-bind is set, on its own listener.
+func serveMetrics() {
+	if metricsBind == "" {
+		http.Handle("/metrics", promhttp.Handler())
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Fatal(http.ListenAndServe(metricsBind, mux))
+	}()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	rateGlobal      float64
+	rateGlobalBurst int
+	ratePerIP       float64
+	ratePerIPBurst  int
+	rateRoutesFlag  string
+)
+
+func init() {
+	flag.Float64Var(&rateGlobal, "rate-global", 0, "give me a global requests/s limit across all clients (0 disables it)")
+	flag.IntVar(&rateGlobalBurst, "rate-global-burst", 1, "give me the burst size for -rate-global")
+	flag.Float64Var(&ratePerIP, "rate-per-ip", 0, "give me a per-IP requests/s limit (0 disables it)")
+	flag.IntVar(&ratePerIPBurst, "rate-per-ip-burst", 1, "give me the burst size for -rate-per-ip")
+	flag.StringVar(&rateRoutesFlag, "rate-routes", "", `give me per-route overrides as "/path=rps,burst;/other=rps,burst"`)
+}
+
+const perIPIdleExpiry = 10 * time.Minute
+
+type routeLimit struct {
+	rps   float64
+	burst int
+}
+
+var routeLimits map[string]routeLimit
+
+func parseRouteLimits(s string) map[string]routeLimit {
+	limits := map[string]routeLimit{}
+	if s == "" {
+		return limits
+	}
+
+	for _, route := range strings.Split(s, ";") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		pathAndRate := strings.SplitN(route, "=", 2)
+		if len(pathAndRate) != 2 {
+			continue
+		}
+
+		parts := strings.Split(pathAndRate[1], ",")
+		if len(parts) != 2 {
+			continue
+		}
+
+		rps, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			continue
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+
+		limits[pathAndRate[0]] = routeLimit{rps: rps, burst: burst}
+	}
+
+	return limits
+}
+
+var globalLimiter *rate.Limiter
+
+type perIPLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	perIPMutex    sync.Mutex
+	perIPLimiters = map[string]*perIPLimiter{}
+)
+
+func setupRateLimiting() {
+	routeLimits = parseRouteLimits(rateRoutesFlag)
+
+	if rateGlobal > 0 {
+		globalLimiter = rate.NewLimiter(rate.Limit(rateGlobal), rateGlobalBurst)
+	}
+
+	go sweepIdlePerIPLimiters()
+}
+
+func sweepIdlePerIPLimiters() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		perIPMutex.Lock()
+		for key, l := range perIPLimiters {
+			if time.Since(l.lastSeen) > perIPIdleExpiry {
+				delete(perIPLimiters, key)
+			}
+		}
+		perIPMutex.Unlock()
+	}
+}
+
+func getPerIPLimiter(path, ip string) *rate.Limiter {
+	rps, burst := ratePerIP, ratePerIPBurst
+	key := ip
+	if rl, ok := routeLimits[path]; ok {
+		rps, burst = rl.rps, rl.burst
+		key = ip + "|" + path
+	}
+	if rps <= 0 {
+		return nil
+	}
+
+	perIPMutex.Lock()
+	defer perIPMutex.Unlock()
+
+	l, ok := perIPLimiters[key]
+	if !ok {
+		l = &perIPLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		perIPLimiters[key] = l
+	}
+	l.lastSeen = time.Now()
+
+	return l.limiter
+}
+
+// rateLimit wraps h so requests against path are throttled by the global
+// and per-IP buckets before being dispatched.
+func rateLimit(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if globalLimiter != nil {
+			reservation := globalLimiter.Reserve()
+			if !reservation.OK() || reservation.Delay() > 0 {
+				delay := reservation.Delay()
+				reservation.Cancel()
+				rejectRateLimited(w, "global", delay)
+				return
+			}
+		}
+
+		ip := clientIP(r)
+		if limiter := getPerIPLimiter(path, ip); limiter != nil {
+			reservation := limiter.Reserve()
+			if !reservation.OK() || reservation.Delay() > 0 {
+				delay := reservation.Delay()
+				reservation.Cancel()
+				rejectRateLimited(w, "ip", delay)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+func rejectRateLimited(w http.ResponseWriter, bucket string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Bucket string `json:"bucket"`
+	}{
+		Error:  "rate limit exceeded",
+		Bucket: bucket,
+	})
+}
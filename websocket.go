@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	wsMaxMessageSize int64
+	wsPingInterval   time.Duration
+	wsWriteTimeout   time.Duration
+)
+
+func init() {
+	flag.Int64Var(&wsMaxMessageSize, "ws-max-message-size", 1<<20, "give me the max accepted /echo WebSocket message size in bytes")
+	flag.DurationVar(&wsPingInterval, "ws-ping-interval", 30*time.Second, "give me the interval between /echo WebSocket keepalive pings")
+	flag.DurationVar(&wsWriteTimeout, "ws-write-timeout", 10*time.Second, "give me the write deadline for /echo WebSocket messages")
+}
+
+// echoHandler upgrades the connection and dispatches to one of the
+// echo/discard/broadcast modes selected by the ?mode= query parameter.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	conn.EnableWriteCompression(true)
+	conn.SetReadLimit(wsMaxMessageSize)
+
+	websocketActiveConnections.Inc()
+	defer websocketActiveConnections.Dec()
+
+	stopKeepalive := startPingKeepalive(conn)
+	defer stopKeepalive()
+
+	switch r.URL.Query().Get("mode") {
+	case "discard":
+		runEchoDiscard(conn)
+	case "broadcast":
+		runEchoBroadcast(conn)
+	default:
+		runEcho(conn)
+	}
+}
+
+// startPingKeepalive sends a PingMessage every -ws-ping-interval and resets
+// the read deadline on every pong, so an idle or dead client is closed
+// instead of pinning a goroutine forever. The returned func stops the
+// ticker goroutine.
+func startPingKeepalive(conn *websocket.Conn) func() {
+	pongWait := wsPingInterval * 2
+
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(wsPingInterval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// WriteControl is safe to call concurrently with the
+				// handler goroutine's WriteMessage calls on the same
+				// conn; WriteMessage/NextWriter are not, and gorilla
+				// panics the whole process if they race.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// runEcho is the default /echo mode: read a message, print it, write it back.
+func runEcho(conn *websocket.Conn) {
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		websocketMessagesTotal.WithLabelValues("in").Inc()
+		websocketMessageBytes.Observe(float64(len(p)))
+
+		printBinary(p)
+
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteMessage(messageType, p); err != nil {
+			return
+		}
+		websocketMessagesTotal.WithLabelValues("out").Inc()
+		websocketMessageBytes.Observe(float64(len(p)))
+	}
+}
+
+// runEchoDiscard reads and drops every message, for throughput benchmarking
+// without paying for the write half of the round trip.
+func runEchoDiscard(conn *websocket.Conn) {
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		websocketMessagesTotal.WithLabelValues("in").Inc()
+		websocketMessageBytes.Observe(float64(len(p)))
+	}
+}
+
+const broadcastClientSendBuffer = 16
+
+// wsHub fans out every message received from one /echo?mode=broadcast
+// client to all the others.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]bool
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan wsMessage
+}
+
+type wsMessage struct {
+	messageType int
+	payload     []byte
+}
+
+var broadcastHub = &wsHub{clients: map[*wsClient]bool{}}
+
+func (h *wsHub) register(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+func (h *wsHub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// broadcast fans msg out to every other registered client. A client whose
+// send buffer is full is considered slow and disconnected rather than
+// blocking the broadcast for everyone else.
+func (h *wsHub) broadcast(from *wsClient, msg wsMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if c == from {
+			continue
+		}
+
+		select {
+		case c.send <- msg:
+		default:
+			delete(h.clients, c)
+			close(c.send)
+			_ = c.conn.Close()
+		}
+	}
+}
+
+// runEchoBroadcast registers conn with the shared hub, starts its writer
+// goroutine, and fans every message it reads out to the other connected
+// broadcast clients.
+func runEchoBroadcast(conn *websocket.Conn) {
+	client := &wsClient{conn: conn, send: make(chan wsMessage, broadcastClientSendBuffer)}
+
+	broadcastHub.register(client)
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for msg := range client.send {
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(msg.messageType, msg.payload); err != nil {
+				// Force the read loop below to unblock and unregister too,
+				// instead of leaving a dead client registered with the hub
+				// until the next broadcast happens to evict it.
+				broadcastHub.unregister(client)
+				_ = conn.Close()
+				return
+			}
+			websocketMessagesTotal.WithLabelValues("out").Inc()
+			websocketMessageBytes.Observe(float64(len(msg.payload)))
+		}
+	}()
+
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		websocketMessagesTotal.WithLabelValues("in").Inc()
+		websocketMessageBytes.Observe(float64(len(p)))
+
+		broadcastHub.broadcast(client, wsMessage{messageType: messageType, payload: p})
+	}
+
+	broadcastHub.unregister(client)
+	<-writerDone
+}